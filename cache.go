@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/sync/singleflight"
+)
+
+// scrapeCache wraps a tapoCollector so that a scrape is only performed when
+// the previous one is older than maxAge, instead of running on a fixed
+// background interval. Concurrent callers arriving while a scrape is in
+// flight are deduplicated with singleflight rather than each triggering
+// their own scrape.
+type scrapeCache struct {
+	collector *tapoCollector
+	maxAge    time.Duration
+	hardTTL   time.Duration
+
+	// ctx bounds every scrape triggered by ensureFresh. It's the process's
+	// root context rather than any one caller's request context, since a
+	// scrape may be shared (via group below) across several concurrent
+	// /metrics requests and must not be canceled by one of them going away.
+	ctx context.Context
+
+	group singleflight.Group
+
+	mu         sync.RWMutex
+	lastScrape time.Time
+
+	lastScrapeGauge prometheus.Gauge
+}
+
+// newScrapeCache creates a scrapeCache around the given collector. maxAge is
+// how stale the cached values may be before a fresh scrape is triggered;
+// hardTTL is how stale they may be before they are refused entirely. ctx is
+// the process's root context, canceled on shutdown.
+func newScrapeCache(ctx context.Context, collector *tapoCollector, maxAge, hardTTL time.Duration) *scrapeCache {
+	return &scrapeCache{
+		collector: collector,
+		maxAge:    maxAge,
+		hardTTL:   hardTTL,
+		ctx:       ctx,
+		lastScrapeGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tapo_last_scrape_timestamp_seconds",
+			Help: "Tapo exporter - timestamp of the last successful scrape of the whole fleet",
+		}),
+	}
+}
+
+// ensureFresh scrapes the fleet if the cached values are older than maxAge,
+// deduplicating concurrent callers so that a burst of scrape requests only
+// triggers a single scrape.
+func (s *scrapeCache) ensureFresh() {
+	s.mu.RLock()
+	age := time.Since(s.lastScrape)
+	s.mu.RUnlock()
+	if age < s.maxAge {
+		return
+	}
+	_, _, _ = s.group.Do("scrape", func() (interface{}, error) {
+		s.mu.RLock()
+		age := time.Since(s.lastScrape)
+		s.mu.RUnlock()
+		if age < s.maxAge {
+			// another waiter refreshed it while we were acquiring the lock.
+			return nil, nil
+		}
+		s.collector.scrapeAll(s.ctx)
+		now := time.Now()
+		s.mu.Lock()
+		s.lastScrape = now
+		s.mu.Unlock()
+		s.lastScrapeGauge.Set(float64(now.Unix()))
+		return nil, nil
+	})
+}
+
+// stale reports whether the cached values are older than hardTTL and must
+// not be served to Prometheus.
+func (s *scrapeCache) stale() bool {
+	if s.hardTTL <= 0 {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return !s.lastScrape.IsZero() && time.Since(s.lastScrape) > s.hardTTL
+}
+
+// Handler returns an http.Handler that scrapes on demand (subject to
+// maxAge/hardTTL) and then serves the collector's metrics, alongside the
+// standard Go runtime and process metrics every exporter exposes.
+func (s *scrapeCache) Handler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		s.collector,
+		s.lastScrapeGauge,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	next := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.ensureFresh()
+		if s.stale() {
+			http.Error(w, "cached Tapo metrics are stale, refusing to serve them", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
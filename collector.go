@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/tapo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// tapoCollector implements prometheus.Collector, scraping a fleet of Tapo
+// plugs in parallel and exposing the last known value for each gauge. It
+// replaces the previous model of writing directly into package-level
+// GaugeVecs from a single sequential scrape loop.
+type tapoCollector struct {
+	plugsMu       sync.RWMutex
+	plugs         []*tapo.Plug
+	username      string
+	password      string
+	retryInterval time.Duration
+	// parallelism bounds how many plugs are scraped concurrently.
+	parallelism int
+	// scrapeTimeout bounds each individual tapo call (Handshake,
+	// GetDeviceInfo, GetDeviceUsage, GetEnergyUsage), so that one hung plug
+	// can't wedge a scrape past this long; 0 disables the bound.
+	scrapeTimeout time.Duration
+
+	deviceInfoGauge          *prometheus.GaugeVec
+	deviceRequestFailedGauge *prometheus.GaugeVec
+
+	deviceOnGauge         *prometheus.GaugeVec
+	deviceOverheatedGauge *prometheus.GaugeVec
+
+	timeUsageTodayGauge  *prometheus.GaugeVec
+	timeUsagePast7Gauge  *prometheus.GaugeVec
+	timeUsagePast30Gauge *prometheus.GaugeVec
+
+	powerUsageTodayGauge  *prometheus.GaugeVec
+	powerUsagePast7Gauge  *prometheus.GaugeVec
+	powerUsagePast30Gauge *prometheus.GaugeVec
+
+	savedPowerTodayGauge  *prometheus.GaugeVec
+	savedPowerPast7Gauge  *prometheus.GaugeVec
+	savedPowerPast30Gauge *prometheus.GaugeVec
+
+	todayRuntimeGauge *prometheus.GaugeVec
+	monthRuntimeGauge *prometheus.GaugeVec
+	todayEnergyGauge  *prometheus.GaugeVec
+	monthEnergyGauge  *prometheus.GaugeVec
+
+	electricityCharge0Gauge *prometheus.GaugeVec
+	electricityCharge1Gauge *prometheus.GaugeVec
+	electricityCharge2Gauge *prometheus.GaugeVec
+
+	currentPowerGauge *prometheus.GaugeVec
+
+	// scrapeDurationGauge and scrapeSuccessGauge are the exporter-standard
+	// per-device metrics, following the convention of e.g. node_exporter's
+	// "*_scrape_collector_duration_seconds"/"*_scrape_collector_success".
+	scrapeDurationGauge *prometheus.GaugeVec
+	scrapeSuccessGauge  *prometheus.GaugeVec
+
+	// klapUnsupportedGauge marks devices that refuse every handshake
+	// protocol this client knows, instead of the exporter retrying them
+	// forever or crashing.
+	klapUnsupportedGauge *prometheus.GaugeVec
+}
+
+// newTapoCollector creates a tapoCollector for the given plugs. parallelism
+// must be at least 1.
+func newTapoCollector(plugs []*tapo.Plug, username, password string, retryInterval time.Duration, parallelism int, scrapeTimeout time.Duration) *tapoCollector {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	return &tapoCollector{
+		plugs:         plugs,
+		username:      username,
+		password:      password,
+		retryInterval: retryInterval,
+		parallelism:   parallelism,
+		scrapeTimeout: scrapeTimeout,
+
+		deviceInfoGauge:          makeGauge("tapo_device_info", "Tapo plug - Device info", deviceInfoAllAttributes),
+		deviceRequestFailedGauge: makeGauge("tapo_device_request_failed", "Tapo plug - Device request failed", deviceRequestFailedAttributes),
+
+		deviceOnGauge:         makeGauge("tapo_plug_device_on", "Tapo plug - device on", deviceInfoAttributes),
+		deviceOverheatedGauge: makeGauge("tapo_plug_device_overheated", "Tapo plug - device overheated", deviceInfoAttributes),
+
+		timeUsageTodayGauge:  makeGauge("tapo_plug_time_usage_today", "Tapo plug - time usage today", deviceInfoAttributes),
+		timeUsagePast7Gauge:  makeGauge("tapo_plug_time_usage_past7", "Tapo plug - time usage past 7 days", deviceInfoAttributes),
+		timeUsagePast30Gauge: makeGauge("tapo_plug_time_usage_past30", "Tapo plug - time usage past 30 days", deviceInfoAttributes),
+
+		powerUsageTodayGauge:  makeGauge("tapo_plug_power_usage_today", "Tapo plug - power usage today", deviceInfoAttributes),
+		powerUsagePast7Gauge:  makeGauge("tapo_plug_power_usage_past7", "Tapo plug - power usage past 7 days", deviceInfoAttributes),
+		powerUsagePast30Gauge: makeGauge("tapo_plug_power_usage_past30", "Tapo plug - power usage past 30 days", deviceInfoAttributes),
+
+		savedPowerTodayGauge:  makeGauge("tapo_plug_saved_power_today", "Tapo plug - saved power today", deviceInfoAttributes),
+		savedPowerPast7Gauge:  makeGauge("tapo_plug_saved_usage_past7", "Tapo plug - saved power past 7 days", deviceInfoAttributes),
+		savedPowerPast30Gauge: makeGauge("tapo_plug_saved_power_past30", "Tapo plug - saved power past 30 days", deviceInfoAttributes),
+
+		todayRuntimeGauge: makeGauge("tapo_plug_today_runtime", "Tapo plug - today runtime", deviceInfoAttributes),
+		monthRuntimeGauge: makeGauge("tapo_plug_month_runtime", "Tapo plug - month runtime", deviceInfoAttributes),
+		todayEnergyGauge:  makeGauge("tapo_plug_today_energy", "Tapo plug - today energy", deviceInfoAttributes),
+		monthEnergyGauge:  makeGauge("tapo_plug_month_energy", "Tapo plug - month energy", deviceInfoAttributes),
+
+		electricityCharge0Gauge: makeGauge("tapo_plug_electricity_charge_0", "Tapo plug - electricity charge 0", deviceInfoAttributes),
+		electricityCharge1Gauge: makeGauge("tapo_plug_electricity_charge_1", "Tapo plug - electricity charge 1", deviceInfoAttributes),
+		electricityCharge2Gauge: makeGauge("tapo_plug_electricity_charge_2", "Tapo plug - electricity charge 2", deviceInfoAttributes),
+
+		currentPowerGauge: makeGauge("tapo_plug_current_power", "Tapo plug - current power", deviceInfoAttributes),
+
+		scrapeDurationGauge: makeGauge("tapo_scrape_collector_duration_seconds", "Tapo exporter - time it took to scrape a device", []string{"device"}),
+		scrapeSuccessGauge:  makeGauge("tapo_scrape_collector_success", "Tapo exporter - whether the scrape of a device succeeded", []string{"device"}),
+
+		klapUnsupportedGauge: makeGauge("tapo_device_klap_unsupported", "Tapo exporter - whether a device refused every handshake protocol this client knows", []string{"ip"}),
+	}
+}
+
+// login performs the handshake for a plug.
+func (c *tapoCollector) login(plug *tapo.Plug) error {
+	return transportLogin(plug, c.username, c.password, c.klapUnsupportedGauge)
+}
+
+// gauges returns every GaugeVec owned by the collector.
+func (c *tapoCollector) gauges() []*prometheus.GaugeVec {
+	return []*prometheus.GaugeVec{
+		c.deviceInfoGauge,
+		c.deviceRequestFailedGauge,
+		c.deviceOnGauge,
+		c.deviceOverheatedGauge,
+		c.timeUsageTodayGauge,
+		c.timeUsagePast7Gauge,
+		c.timeUsagePast30Gauge,
+		c.powerUsageTodayGauge,
+		c.powerUsagePast7Gauge,
+		c.powerUsagePast30Gauge,
+		c.savedPowerTodayGauge,
+		c.savedPowerPast7Gauge,
+		c.savedPowerPast30Gauge,
+		c.todayRuntimeGauge,
+		c.monthRuntimeGauge,
+		c.todayEnergyGauge,
+		c.monthEnergyGauge,
+		c.electricityCharge0Gauge,
+		c.electricityCharge1Gauge,
+		c.electricityCharge2Gauge,
+		c.currentPowerGauge,
+		c.scrapeDurationGauge,
+		c.scrapeSuccessGauge,
+		c.klapUnsupportedGauge,
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *tapoCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, g := range c.gauges() {
+		g.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector. It just streams out the
+// last-known value of every gauge; the actual scraping happens out of band
+// in scrapeAll, so that a slow Prometheus scrape can't block on a slow plug.
+func (c *tapoCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, g := range c.gauges() {
+		g.Collect(ch)
+	}
+}
+
+// setPlugs atomically replaces the set of plugs being scraped, so that
+// discovery can add or remove devices without racing with scrapeAll.
+func (c *tapoCollector) setPlugs(plugs []*tapo.Plug) {
+	c.plugsMu.Lock()
+	c.plugs = plugs
+	c.plugsMu.Unlock()
+}
+
+// getPlugs returns the current set of plugs being scraped.
+func (c *tapoCollector) getPlugs() []*tapo.Plug {
+	c.plugsMu.RLock()
+	defer c.plugsMu.RUnlock()
+	return c.plugs
+}
+
+// scrapeAll fans out a scrape to every plug, bounded by c.parallelism
+// concurrent workers, and waits for all of them to finish. It stops
+// dispatching new scrapes as soon as ctx is canceled, e.g. on shutdown.
+func (c *tapoCollector) scrapeAll(ctx context.Context) {
+	sem := make(chan struct{}, c.parallelism)
+	var wg sync.WaitGroup
+	for _, plug := range c.getPlugs() {
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(plug *tapo.Plug) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			c.scrapeOne(ctx, plug)
+		}(plug)
+	}
+	wg.Wait()
+}
+
+// scrapeOne scrapes a single plug, timing the attempt and recording its
+// success/failure in scrapeDurationGauge/scrapeSuccessGauge.
+func (c *tapoCollector) scrapeOne(ctx context.Context, plug *tapo.Plug) {
+	device := plug.Addr.String()
+	start := time.Now()
+	err := c.scrapePlug(ctx, plug)
+	c.scrapeDurationGauge.WithLabelValues(device).Set(time.Since(start).Seconds())
+	if err != nil {
+		c.scrapeSuccessGauge.WithLabelValues(device).Set(0)
+		logger.WithFields(plugFields(plug)).WithError(err).Error("Scrape of plug failed")
+		return
+	}
+	c.scrapeSuccessGauge.WithLabelValues(device).Set(1)
+}
+
+// withTimeout runs fn bounded by c.scrapeTimeout (if set) and by ctx, so
+// that neither a hung plug call nor a canceled ctx can block past their
+// respective deadlines. Note that the tapo client has no context support of
+// its own, so a timed-out fn keeps running in the background until it
+// eventually returns; only the caller stops waiting on it.
+func (c *tapoCollector) withTimeout(ctx context.Context, fn func() error) error {
+	if c.scrapeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.scrapeTimeout)
+		defer cancel()
+	}
+	errCh := make(chan error, 1)
+	go func() { errCh <- fn() }()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// scrapePlug logs in and fetches device info, usage and (where supported)
+// energy usage for a single plug, and sets all the corresponding gauges.
+func (c *tapoCollector) scrapePlug(ctx context.Context, plug *tapo.Plug) error {
+	logger.WithFields(plugFields(plug)).Debug("Fetching metrics for plug")
+	plug = tapo.NewPlug(plug.Addr, nil)
+	if err := c.withTimeout(ctx, func() error { return c.login(plug) }); err != nil {
+		c.deviceRequestFailedGauge.WithLabelValues(plug.Addr.String(), err.Error()).Inc()
+		return err
+	}
+	const maxAttempts = 3
+	var (
+		i   *tapo.DeviceInfo
+		u   *tapo.DeviceUsage
+		e   *tapo.EnergyUsage
+		err error
+	)
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		err = c.withTimeout(ctx, func() error {
+			var err error
+			i, err = plug.GetDeviceInfo()
+			return err
+		})
+		if err != nil {
+			c.deviceRequestFailedGauge.WithLabelValues(plug.Addr.String(), err.Error()).Inc()
+			logger.WithFields(plugFields(plug)).WithFields(logrus.Fields{"attempt": attempt}).WithError(err).Warn("GetDeviceInfo failed, retrying")
+			if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+				// the call is still running in the background against this
+				// plug's connection; retrying now would race a second call
+				// against it, so give up instead.
+				break
+			}
+			if attempt < maxAttempts {
+				time.Sleep(c.retryInterval)
+			}
+			continue
+		}
+		break
+	}
+	if err != nil {
+		return fmt.Errorf("GetDeviceInfo failed after %d attempts: %w", maxAttempts, err)
+	}
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		err = c.withTimeout(ctx, func() error {
+			var err error
+			u, err = plug.GetDeviceUsage()
+			return err
+		})
+		if err != nil {
+			c.deviceRequestFailedGauge.WithLabelValues(plug.Addr.String(), err.Error()).Inc()
+			logger.WithFields(plugFields(plug)).WithFields(logrus.Fields{"attempt": attempt}).WithError(err).Warn("GetDeviceUsage failed, retrying")
+			if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+				break
+			}
+			if attempt < maxAttempts {
+				time.Sleep(c.retryInterval)
+			}
+			continue
+		}
+		break
+	}
+	if err != nil {
+		return fmt.Errorf("GetDeviceUsage failed after %d attempts: %w", maxAttempts, err)
+	}
+	hasPowerInformation := false
+	for _, m := range modelsWithPowerInformation {
+		if strings.EqualFold(i.Model, m) {
+			hasPowerInformation = true
+		}
+	}
+	if hasPowerInformation {
+		for attempt := 1; attempt <= maxAttempts; attempt++ {
+			err = c.withTimeout(ctx, func() error {
+				var err error
+				e, err = plug.GetEnergyUsage()
+				return err
+			})
+			if err != nil {
+				c.deviceRequestFailedGauge.WithLabelValues(plug.Addr.String(), err.Error()).Inc()
+				logger.WithFields(plugFields(plug)).WithFields(logrus.Fields{"attempt": attempt}).WithError(err).Warn("GetEnergyUsage failed, retrying")
+				if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+					break
+				}
+				if attempt < maxAttempts {
+					time.Sleep(c.retryInterval)
+				}
+				continue
+			}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("GetEnergyUsage failed after %d attempts: %w", maxAttempts, err)
+		}
+	} else {
+		logger.WithFields(plugFields(plug)).WithField("model", i.Model).Debug("Ignoring device without power information")
+	}
+
+	labels := []string{
+		i.DeviceID, i.DecodedNickname, i.Model, i.MAC, i.OEMID,
+	}
+	allLabels := append(
+		append([]string{}, labels...),
+		i.FWVersion,
+		i.HWVersion,
+		i.Type,
+		i.HWID,
+		i.FWID,
+		i.IP,
+		strconv.FormatInt(int64(i.TimeDiff), 10),
+		i.DecodedSSID,
+		strconv.FormatInt(int64(i.RSSI), 10),
+		strconv.FormatInt(int64(i.SignalLevel), 10),
+		strconv.FormatInt(int64(i.Latitude), 10),
+		strconv.FormatInt(int64(i.Longitude), 10),
+		i.Lang,
+		i.Avatar,
+		i.Region,
+		i.Specs,
+		strconv.FormatBool(i.HasSetLocationInfo),
+		strconv.FormatBool(i.DeviceON),
+		strconv.FormatInt(int64(i.OnTime), 10),
+		strconv.FormatBool(i.OverHeated),
+		i.PowerProtectionStatus,
+		i.Location,
+	)
+	c.deviceInfoGauge.WithLabelValues(allLabels...).Set(1)
+	if i.DeviceON {
+		c.deviceOnGauge.WithLabelValues(labels...).Set(1)
+	} else {
+		c.deviceOnGauge.WithLabelValues(labels...).Set(0)
+	}
+	if i.OverHeated {
+		c.deviceOverheatedGauge.WithLabelValues(labels...).Set(1)
+	} else {
+		c.deviceOverheatedGauge.WithLabelValues(labels...).Set(0)
+	}
+	c.timeUsageTodayGauge.WithLabelValues(labels...).Set(float64(u.TimeUsage.Today))
+	c.timeUsagePast7Gauge.WithLabelValues(labels...).Set(float64(u.TimeUsage.Past7))
+	c.timeUsagePast30Gauge.WithLabelValues(labels...).Set(float64(u.TimeUsage.Past30))
+	c.powerUsageTodayGauge.WithLabelValues(labels...).Set(float64(u.PowerUsage.Today))
+	c.powerUsagePast7Gauge.WithLabelValues(labels...).Set(float64(u.PowerUsage.Past7))
+	c.powerUsagePast30Gauge.WithLabelValues(labels...).Set(float64(u.PowerUsage.Past30))
+	c.savedPowerTodayGauge.WithLabelValues(labels...).Set(float64(u.SavedPower.Today))
+	c.savedPowerPast7Gauge.WithLabelValues(labels...).Set(float64(u.SavedPower.Past7))
+	c.savedPowerPast30Gauge.WithLabelValues(labels...).Set(float64(u.SavedPower.Past30))
+	if e != nil {
+		c.todayRuntimeGauge.WithLabelValues(labels...).Set(float64(e.TodayRuntime))
+		c.monthRuntimeGauge.WithLabelValues(labels...).Set(float64(e.MonthRuntime))
+		c.todayEnergyGauge.WithLabelValues(labels...).Set(float64(e.TodayEnergy))
+		c.monthEnergyGauge.WithLabelValues(labels...).Set(float64(e.MonthEnergy))
+		c.electricityCharge0Gauge.WithLabelValues(labels...).Set(float64(e.ElectricityCharge[0]))
+		c.electricityCharge1Gauge.WithLabelValues(labels...).Set(float64(e.ElectricityCharge[1]))
+		c.electricityCharge2Gauge.WithLabelValues(labels...).Set(float64(e.ElectricityCharge[2]))
+		c.currentPowerGauge.WithLabelValues(labels...).Set(float64(e.CurrentPower))
+	}
+	return nil
+}
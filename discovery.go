@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/xjson"
+	"github.com/sirupsen/logrus"
+	"github.com/unpoller/unifi"
+)
+
+// Discovery produces the set of Tapo plug addresses to monitor. It is
+// implemented by staticDiscovery, urlDiscovery and unifiDiscovery, so that
+// the exporter can track a dynamic fleet instead of relying on a fixed
+// device list or a separate discovery binary.
+type Discovery interface {
+	Discover(ctx context.Context) ([]netip.Addr, error)
+}
+
+// DiscoveryConfig is the JSON representation of a single discovery source in
+// Config.Discovery. Type selects which of the type-specific fields is used.
+type DiscoveryConfig struct {
+	Type string `json:"type"`
+
+	// used when Type == "static"
+	Devices []netip.Addr `json:"devices,omitempty"`
+
+	// used when Type == "url"
+	URL *xjson.URL `json:"url,omitempty"`
+
+	// used when Type == "unifi"
+	Unifi *UnifiDiscoveryConfig `json:"unifi,omitempty"`
+}
+
+// UnifiDiscoveryConfig configures discovery of Tapo plugs via a Unifi
+// controller's client list.
+type UnifiDiscoveryConfig struct {
+	ControllerURL string `json:"controller_url"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	Site          string `json:"site"`
+
+	// NameSubstrings are lower-cased substrings matched against a client's
+	// name, hostname and OUI vendor string.
+	NameSubstrings []string `json:"name_substrings,omitempty"`
+	// ModelPrefixes are matched case-insensitively as a prefix of the same
+	// fields, for devices that report their model there (e.g. "P110").
+	ModelPrefixes []string `json:"model_prefixes,omitempty"`
+}
+
+// defaultUnifiNameSubstrings and defaultUnifiModelPrefixes are used when a
+// UnifiDiscoveryConfig doesn't override them, matching the heuristic that
+// used to live in cmd/unifi-list-tapo.
+var (
+	defaultUnifiNameSubstrings = []string{"tapo"}
+	defaultUnifiModelPrefixes  = []string{"p110", "p115", "p125m"}
+)
+
+// defaultUnifiTimeout bounds calls to the Unifi controller; the unifi
+// client's own Timeout field defaults to waiting forever otherwise.
+const defaultUnifiTimeout = 30 * time.Second
+
+// newDiscoverers builds the Discovery sources described by config, including
+// the legacy Devices/DevicesURL fields for backward compatibility.
+func newDiscoverers(config *Config) ([]Discovery, error) {
+	var discoverers []Discovery
+	if len(config.Devices) > 0 {
+		discoverers = append(discoverers, staticDiscovery{devices: config.Devices})
+	}
+	if config.DevicesURL != nil {
+		discoverers = append(discoverers, urlDiscovery{url: config.DevicesURL})
+	}
+	for _, dc := range config.Discovery {
+		d, err := newDiscoverer(dc)
+		if err != nil {
+			return nil, err
+		}
+		discoverers = append(discoverers, d)
+	}
+	return discoverers, nil
+}
+
+func newDiscoverer(dc DiscoveryConfig) (Discovery, error) {
+	switch dc.Type {
+	case "static":
+		return staticDiscovery{devices: dc.Devices}, nil
+	case "url":
+		if dc.URL == nil {
+			return nil, fmt.Errorf("discovery type 'url' requires a 'url' field")
+		}
+		return urlDiscovery{url: dc.URL}, nil
+	case "unifi":
+		if dc.Unifi == nil {
+			return nil, fmt.Errorf("discovery type 'unifi' requires a 'unifi' field")
+		}
+		return newUnifiDiscovery(dc.Unifi), nil
+	default:
+		return nil, fmt.Errorf("unknown discovery type '%s'", dc.Type)
+	}
+}
+
+// discoverAll runs every discoverer and returns the de-duplicated union of
+// their results.
+func discoverAll(ctx context.Context, discoverers []Discovery) ([]netip.Addr, error) {
+	seen := make(map[netip.Addr]struct{})
+	var addrs []netip.Addr
+	for _, d := range discoverers {
+		found, err := d.Discover(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range found {
+			if _, ok := seen[a]; ok {
+				continue
+			}
+			seen[a] = struct{}{}
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs, nil
+}
+
+// staticDiscovery returns a fixed list of addresses, mirroring the original
+// Config.Devices field.
+type staticDiscovery struct {
+	devices []netip.Addr
+}
+
+func (s staticDiscovery) Discover(ctx context.Context) ([]netip.Addr, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.devices, nil
+}
+
+// urlDiscovery fetches a newline-separated list of IP addresses from a URL,
+// mirroring the original Config.DevicesURL field. A "file://" scheme reads
+// from the local filesystem instead of performing an HTTP request.
+type urlDiscovery struct {
+	url *xjson.URL
+}
+
+func (u urlDiscovery) Discover(ctx context.Context) ([]netip.Addr, error) {
+	var (
+		data []byte
+		err  error
+	)
+	logger.WithField("url", u.url.String()).Info("Retrieving devices list from URL")
+	if u.url.Scheme == "file" {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		filePath := path.Join(u.url.Host, u.url.Path)
+		data, err = os.ReadFile(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read '%s': %w", filePath, err)
+		}
+	} else {
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, (*u.url).String(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build request for devices URL '%s': %w", u.url, err)
+		}
+		var resp *http.Response
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve devices URL '%s': %w", u.url, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("HTTP request failed, expected 200 OK, got %s", resp.Status)
+		}
+		data, err = io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read HTTP body: %w", err)
+		}
+	}
+	var devices []netip.Addr
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		addr, err := netip.ParseAddr(line)
+		if err != nil {
+			logger.WithField("line", line).Warn("Skipping invalid IP address")
+			continue
+		}
+		devices = append(devices, addr)
+	}
+	logger.WithField("count", len(devices)).Info("Got devices from URL")
+	return devices, nil
+}
+
+// unifiDiscovery finds Tapo plugs by walking the client list of a Unifi
+// controller site, matching on name/hostname substrings and model prefixes.
+// This replaces the standalone cmd/unifi-list-tapo helper.
+type unifiDiscovery struct {
+	config *UnifiDiscoveryConfig
+}
+
+func newUnifiDiscovery(config *UnifiDiscoveryConfig) unifiDiscovery {
+	return unifiDiscovery{config: config}
+}
+
+// Discover connects to the configured Unifi controller and walks its client
+// list. The unifi client has no context support of its own, so the request
+// is bounded by both config.Timeout (derived from ctx's deadline, if any)
+// and a goroutine racing ctx.Done(), mirroring tapoCollector.withTimeout: a
+// canceled ctx stops the caller from waiting, though the request itself
+// keeps running in the background until it completes.
+func (u unifiDiscovery) Discover(ctx context.Context) ([]netip.Addr, error) {
+	timeout := defaultUnifiTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if d := time.Until(deadline); d > 0 && d < timeout {
+			timeout = d
+		}
+	}
+
+	type result struct {
+		devices []netip.Addr
+		err     error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		devices, err := u.discover(timeout)
+		resCh <- result{devices, err}
+	}()
+	select {
+	case res := <-resCh:
+		return res.devices, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (u unifiDiscovery) discover(timeout time.Duration) ([]netip.Addr, error) {
+	c := unifi.Config{
+		User:     u.config.Username,
+		Pass:     u.config.Password,
+		URL:      u.config.ControllerURL,
+		Timeout:  timeout,
+		ErrorLog: func(format string, args ...interface{}) { logger.Errorf(format, args...) },
+	}
+	uni, err := unifi.NewUnifi(&c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Unifi controller '%s': %w", u.config.ControllerURL, err)
+	}
+	sites, err := uni.GetSites()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Unifi sites: %w", err)
+	}
+	siteIdx := -1
+	for idx, site := range sites {
+		if site.Name == u.config.Site {
+			siteIdx = idx
+		}
+	}
+	if siteIdx == -1 {
+		return nil, fmt.Errorf("Unifi site '%s' not found", u.config.Site)
+	}
+	clients, err := uni.GetClients([]*unifi.Site{sites[siteIdx]})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Unifi clients: %w", err)
+	}
+
+	var devices []netip.Addr
+	for _, client := range clients {
+		if !u.isTapoPlug(client) {
+			continue
+		}
+		addr, err := netip.ParseAddr(client.IP)
+		if err != nil {
+			logger.WithFields(logrus.Fields{"name": client.Name, "ip": client.IP}).WithError(err).Warn("Skipping Unifi client with invalid IP")
+			continue
+		}
+		devices = append(devices, addr)
+	}
+	return devices, nil
+}
+
+// isTapoPlug applies the configurable name/hostname/model heuristic to
+// decide whether a Unifi client is a Tapo plug with a power meter.
+func (u unifiDiscovery) isTapoPlug(client *unifi.Client) bool {
+	substrings := u.config.NameSubstrings
+	if len(substrings) == 0 {
+		substrings = defaultUnifiNameSubstrings
+	}
+	prefixes := u.config.ModelPrefixes
+	if len(prefixes) == 0 {
+		prefixes = defaultUnifiModelPrefixes
+	}
+	fields := []string{
+		strings.ToLower(client.Name),
+		strings.ToLower(client.Hostname),
+		strings.ToLower(client.Oui),
+	}
+	for _, f := range fields {
+		for _, sub := range substrings {
+			if strings.Contains(f, strings.ToLower(sub)) {
+				return true
+			}
+		}
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(f, strings.ToLower(prefix)) {
+				return true
+			}
+		}
+	}
+	return false
+}
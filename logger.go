@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/insomniacslk/tapo"
+	"github.com/sirupsen/logrus"
+)
+
+// logger is the package-wide structured logger, configured by initLogger
+// from the -log-level/-log-format flags before anything else runs.
+var logger = logrus.New()
+
+// initLogger configures the package-wide logger's level and output format.
+func initLogger(level, format string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("invalid log level '%s': %w", level, err)
+	}
+	logger.SetLevel(lvl)
+	switch format {
+	case "text":
+		logger.SetFormatter(&logrus.TextFormatter{})
+	case "json":
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("invalid log format '%s', must be 'text' or 'json'", format)
+	}
+	logger.SetOutput(os.Stderr)
+	return nil
+}
+
+// plugFields builds the structured fields attached to every log line about
+// a specific plug.
+func plugFields(plug *tapo.Plug) logrus.Fields {
+	return logrus.Fields{
+		"device_ip": plug.Addr.String(),
+	}
+}
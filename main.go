@@ -1,35 +1,36 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"log"
 	"net/http"
 	"net/netip"
 	"os"
-	"path"
-	"strconv"
-	"strings"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/insomniacslk/tapo"
 	"github.com/insomniacslk/xjson"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
 )
 
 var (
-	flagPath            = flag.String("p", "/metrics", "HTTP path where to expose metrics to")
-	flagListen          = flag.String("l", ":9105", "Address to listen to")
-	flagConfigFile      = flag.String("c", "config.json", "Configuration file")
-	flagSleepInterval   = flag.Duration("i", time.Minute, "Interval between reading updates, expressed as a Go duration string")
-	flagRetryInterval   = flag.Duration("R", 2*time.Second, "Interval between attempts to read a device's info, expressed as a Go duration string")
-	flagStopOnKlapError = flag.Bool("k", false, "Stop the exporter if login fails on a plug because of unsupported KLAP protocol")
+	flagPath              = flag.String("p", "/metrics", "HTTP path where to expose metrics to")
+	flagListen            = flag.String("l", ":9105", "Address to listen to")
+	flagConfigFile        = flag.String("c", "config.json", "Configuration file")
+	flagRetryInterval     = flag.Duration("R", 2*time.Second, "Interval between attempts to read a device's info, expressed as a Go duration string")
+	flagParallelism       = flag.Int("parallelism", 4, "Number of plugs to scrape concurrently")
+	flagMaxAge            = flag.Duration("max-age", 15*time.Second, "Maximum age of cached metrics before a new scrape is triggered on a /metrics hit")
+	flagHardTTL           = flag.Duration("hard-ttl", 5*time.Minute, "Maximum age of cached metrics before they are refused instead of served stale; 0 disables the check")
+	flagDiscoveryInterval = flag.Duration("discovery-interval", 5*time.Minute, "Interval between discovery refreshes; 0 disables periodic refresh")
+	flagLogLevel          = flag.String("log-level", "info", "Log level (debug, info, warn, error)")
+	flagLogFormat         = flag.String("log-format", "text", "Log format (text, json)")
+	flagScrapeTimeout     = flag.Duration("scrape-timeout", 30*time.Second, "Timeout for each individual call (handshake, device info, device usage, energy usage) made to a plug during a scrape; 0 disables the timeout")
+	flagShutdownTimeout   = flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for in-flight requests to finish on shutdown before forcing the server closed")
 )
 
 // Config is the configuration file type.
@@ -38,6 +39,11 @@ type Config struct {
 	Password   string       `json:"password"`
 	Devices    []netip.Addr `json:"devices"`
 	DevicesURL *xjson.URL   `json:"devices_url,omitempty"`
+
+	// Discovery lists additional, pluggable sources of Tapo plug addresses
+	// (e.g. a Unifi controller), on top of the legacy Devices/DevicesURL
+	// fields above.
+	Discovery []DiscoveryConfig `json:"discovery,omitempty"`
 }
 
 var modelsWithPowerInformation = []string{
@@ -70,7 +76,7 @@ func makeGauge(name, help string, attributes []string) *prometheus.GaugeVec {
 	)
 }
 
-// gauges for Tapo's smart plugs.
+// label names shared by most of the gauges in collector.go.
 var (
 	deviceInfoAttributes = []string{
 		"device_id", "nickname", "model", "mac", "oem_id",
@@ -82,35 +88,6 @@ var (
 		"overheated", "power_protection_status", "location",
 	}
 	deviceRequestFailedAttributes = []string{"ip_address", "error"}
-
-	deviceInfoGauge          = makeGauge("tapo_device_info", "Tapo plug - Device info", deviceInfoAllAttributes)
-	deviceRequestFailedGauge = makeGauge("tapo_device_request_failed", "Tapo plug - Device request failed", deviceRequestFailedAttributes)
-
-	deviceOnGauge         = makeGauge("tapo_plug_device_on", "Tapo plug - device on", deviceInfoAttributes)
-	deviceOverheatedGauge = makeGauge("tapo_plug_device_overheated", "Tapo plug - device overheated", deviceInfoAttributes)
-
-	timeUsageTodayGauge  = makeGauge("tapo_plug_time_usage_today", "Tapo plug - time usage today", deviceInfoAttributes)
-	timeUsagePast7Gauge  = makeGauge("tapo_plug_time_usage_past7", "Tapo plug - time usage past 7 days", deviceInfoAttributes)
-	timeUsagePast30Gauge = makeGauge("tapo_plug_time_usage_past30", "Tapo plug - time usage past 30 days", deviceInfoAttributes)
-
-	powerUsageTodayGauge  = makeGauge("tapo_plug_power_usage_today", "Tapo plug - power usage today", deviceInfoAttributes)
-	powerUsagePast7Gauge  = makeGauge("tapo_plug_power_usage_past7", "Tapo plug - power usage past 7 days", deviceInfoAttributes)
-	powerUsagePast30Gauge = makeGauge("tapo_plug_power_usage_past30", "Tapo plug - power usage past 30 days", deviceInfoAttributes)
-
-	savedPowerTodayGauge  = makeGauge("tapo_plug_saved_power_today", "Tapo plug - saved power today", deviceInfoAttributes)
-	savedPowerPast7Gauge  = makeGauge("tapo_plug_saved_usage_past7", "Tapo plug - saved power past 7 days", deviceInfoAttributes)
-	savedPowerPast30Gauge = makeGauge("tapo_plug_saved_power_past30", "Tapo plug - saved power past 30 days", deviceInfoAttributes)
-
-	todayRuntimeGauge = makeGauge("tapo_plug_today_runtime", "Tapo plug - today runtime", deviceInfoAttributes)
-	monthRuntimeGauge = makeGauge("tapo_plug_month_runtime", "Tapo plug - month runtime", deviceInfoAttributes)
-	todayEnergyGauge  = makeGauge("tapo_plug_today_energy", "Tapo plug - today energy", deviceInfoAttributes)
-	monthEnergyGauge  = makeGauge("tapo_plug_month_energy", "Tapo plug - month energy", deviceInfoAttributes)
-
-	electricityCharge0Gauge = makeGauge("tapo_plug_electricity_charge_0", "Tapo plug - electricity charge 0", deviceInfoAttributes)
-	electricityCharge1Gauge = makeGauge("tapo_plug_electricity_charge_1", "Tapo plug - electricity charge 1", deviceInfoAttributes)
-	electricityCharge2Gauge = makeGauge("tapo_plug_electricity_charge_2", "Tapo plug - electricity charge 2", deviceInfoAttributes)
-
-	currentPowerGauge = makeGauge("tapo_plug_current_power", "Tapo plug - current power", deviceInfoAttributes)
 )
 
 func validateDevices(devices []netip.Addr) ([]netip.Addr, error) {
@@ -121,7 +98,7 @@ func validateDevices(devices []netip.Addr) ([]netip.Addr, error) {
 	tmap := make(map[netip.Addr]struct{})
 	for _, d := range devices {
 		if _, exists := tmap[d]; exists {
-			log.Printf("Ignoring duplicate device %s", d)
+			logger.WithField("device_ip", d.String()).Warn("Ignoring duplicate device")
 		}
 		tmap[d] = struct{}{}
 	}
@@ -135,294 +112,141 @@ func validateDevices(devices []netip.Addr) ([]netip.Addr, error) {
 	return uniqueDevices, nil
 }
 
-func main() {
-	flag.Parse()
-	config, err := LoadConfig(*flagConfigFile)
-	if err != nil {
-		log.Fatalf("Failed to load configuration file '%s': %v", *flagConfigFile, err)
+// loginPlugs logs in to every address in devices, returning one *tapo.Plug
+// per address regardless of whether the login succeeded (a plug that failed
+// to log in is retried on the next scrape; see collector.login). Each login
+// is bounded by the collector's scrape timeout and by ctx, so that one
+// unresponsive device at startup can't block the exporter from ever
+// listening or honoring shutdown.
+func loginPlugs(ctx context.Context, collector *tapoCollector, devices []netip.Addr) []*tapo.Plug {
+	plugs := make([]*tapo.Plug, 0, len(devices))
+	for _, addr := range devices {
+		plug := tapo.NewPlug(addr, nil)
+		_ = collector.withTimeout(ctx, func() error { return collector.login(plug) })
+		plugs = append(plugs, plug)
 	}
-	devices := config.Devices
-	if config.DevicesURL != nil {
-		// also get a device list from an URL
-		var (
-			data []byte
-			err  error
-		)
-		log.Printf("Retrieving devices list from '%s'", *config.DevicesURL)
-		if config.DevicesURL.Scheme == "file" {
-			filePath := path.Join(config.DevicesURL.Host, config.DevicesURL.Path)
-			data, err = os.ReadFile(filePath)
-			if err != nil {
-				log.Fatalf("Failed to read '%s': %v", filePath, err)
-			}
-		} else {
-			var resp *http.Response
-			resp, err = http.Get((*config.DevicesURL).String())
-			if err != nil {
-				log.Fatalf("Failed to retrieve devices URL '%s': %v", *config.DevicesURL, err)
-			}
-			if resp.StatusCode != 200 {
-				_ = resp.Body.Close()
-				log.Fatalf("HTTP request failed, expected 200 OK, got %s", resp.Status)
-			}
-			data, err = io.ReadAll(resp.Body)
-			if err != nil {
-				_ = resp.Body.Close()
-				log.Fatalf("Failed to read HTTP body: %v", err)
-			}
-			_ = resp.Body.Close()
+	return plugs
+}
+
+// refreshDiscovery periodically re-runs discoverers, diffs the result
+// against the collector's current plug set, logs in to newly found plugs
+// and drops removed ones.
+func refreshDiscovery(ctx context.Context, discoverers []Discovery, collector *tapoCollector, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		devices, err := discoverAll(ctx, discoverers)
+		if err != nil {
+			logger.WithError(err).Warn("Discovery refresh failed")
+			continue
 		}
-		scanner := bufio.NewScanner(bytes.NewReader(data))
-		count := 0
-		for scanner.Scan() {
-			line := scanner.Text()
-			addr, err := netip.ParseAddr(line)
-			if err != nil {
-				log.Printf("Skip invalid IP address '%s'", line)
+		devices, err = validateDevices(devices)
+		if err != nil {
+			logger.WithError(err).Warn("Discovery refresh produced an invalid device list")
+			continue
+		}
+		existing := make(map[netip.Addr]*tapo.Plug)
+		for _, plug := range collector.getPlugs() {
+			existing[plug.Addr] = plug
+		}
+		found := make(map[netip.Addr]struct{})
+		plugs := make([]*tapo.Plug, 0, len(devices))
+		added := 0
+		for _, addr := range devices {
+			found[addr] = struct{}{}
+			if plug, ok := existing[addr]; ok {
+				plugs = append(plugs, plug)
 				continue
 			}
-			devices = append(devices, addr)
-			count++
+			plug := tapo.NewPlug(addr, nil)
+			_ = collector.withTimeout(ctx, func() error { return collector.login(plug) })
+			plugs = append(plugs, plug)
+			added++
 		}
-		log.Printf("Got %d devices from URL", count)
-	}
-	devices, err = validateDevices(devices)
-	if err != nil {
-		log.Fatalf("Device validation failed: %v", err)
-	}
-	allPlugs := make([]*tapo.Plug, 0, len(devices))
-	for _, addr := range devices {
-		allPlugs = append(allPlugs, tapo.NewPlug(addr, nil))
-	}
-	fmt.Printf("Trying to log in to %d Tapo plugs\n", len(allPlugs))
-	plugLogin := func(plug *tapo.Plug, username, password string, stopOnKlapError bool) error {
-		if err := plug.Handshake(username, password); err != nil {
-			log.Printf("Error: login failed for plug %s: %v", plug.Addr, err)
-			// some devices with recent firmware require the newer KLAP
-			// protocol from TP-Link, and will fail login until it is
-			// implemented. Handle this error specifically.
-			var te tapo.TapoError
-			if !stopOnKlapError && errors.As(err, &te) {
-				if te == 1003 {
-					log.Printf("Warning: login failed for plug %s, continuing because it's probably a firmware with the new KLAP protocol': %v", plug.Addr, err)
-					return nil
-				}
+		removed := 0
+		for addr := range existing {
+			if _, ok := found[addr]; !ok {
+				removed++
 			}
-			return err
 		}
-		return nil
-	}
-	plugs := make([]*tapo.Plug, 0)
-	for _, plug := range allPlugs {
-		if err := plugLogin(plug, config.Username, config.Password, *flagStopOnKlapError); err != nil {
-			log.Printf("Error: login failed for plug '%s': %v", plug.Addr, err)
+		if added > 0 || removed > 0 {
+			logger.WithFields(logrus.Fields{
+				"added":   added,
+				"removed": removed,
+				"total":   len(plugs),
+			}).Info("Discovery refresh changed the plug set")
 		}
-		plugs = append(plugs, plug)
+		collector.setPlugs(plugs)
 	}
-	fmt.Printf("Monitoring %d Tapo plugs (ignored %d plugs)\n", len(plugs), len(allPlugs)-len(plugs))
+}
 
-	// register gauges
-	if err := prometheus.Register(deviceInfoGauge); err != nil {
-		log.Fatalf("Failed to register device_info gauge: %v", err)
-	}
-	if err := prometheus.Register(deviceRequestFailedGauge); err != nil {
-		log.Fatalf("Failed to register device_request_failed gauge: %v", err)
-	}
-	if err := prometheus.Register(deviceOnGauge); err != nil {
-		log.Fatalf("Failed to register device_on gauge: %v", err)
-	}
-	if err := prometheus.Register(deviceOverheatedGauge); err != nil {
-		log.Fatalf("Failed to register device_overheated gauge: %v", err)
-	}
-	if err := prometheus.Register(timeUsageTodayGauge); err != nil {
-		log.Fatalf("Failed to register time_usage_today gauge: %v", err)
-	}
-	if err := prometheus.Register(timeUsagePast7Gauge); err != nil {
-		log.Fatalf("Failed to register time_usage_past7 gauge: %v", err)
-	}
-	if err := prometheus.Register(timeUsagePast30Gauge); err != nil {
-		log.Fatalf("Failed to register time_usage_past30 gauge: %v", err)
-	}
-	if err := prometheus.Register(powerUsageTodayGauge); err != nil {
-		log.Fatalf("Failed to register power_usage_today gauge: %v", err)
-	}
-	if err := prometheus.Register(powerUsagePast7Gauge); err != nil {
-		log.Fatalf("Failed to register power_usage_past7 gauge: %v", err)
-	}
-	if err := prometheus.Register(powerUsagePast30Gauge); err != nil {
-		log.Fatalf("Failed to register power_usage_past30 gauge: %v", err)
-	}
-	if err := prometheus.Register(savedPowerTodayGauge); err != nil {
-		log.Fatalf("Failed to register saved_power_today gauge: %v", err)
-	}
-	if err := prometheus.Register(savedPowerPast7Gauge); err != nil {
-		log.Fatalf("Failed to register saved_power_past7 gauge: %v", err)
-	}
-	if err := prometheus.Register(savedPowerPast30Gauge); err != nil {
-		log.Fatalf("Failed to register saved_power_past30 gauge: %v", err)
-	}
-	if err := prometheus.Register(todayRuntimeGauge); err != nil {
-		log.Fatalf("Failed to register today_runtime_gauge gauge: %v", err)
-	}
-	if err := prometheus.Register(monthRuntimeGauge); err != nil {
-		log.Fatalf("Failed to register month_runtime_gauge gauge: %v", err)
-	}
-	if err := prometheus.Register(todayEnergyGauge); err != nil {
-		log.Fatalf("Failed to register today_energy_gauge gauge: %v", err)
-	}
-	if err := prometheus.Register(monthEnergyGauge); err != nil {
-		log.Fatalf("Failed to register month_energy_gauge gauge: %v", err)
+func main() {
+	flag.Parse()
+	if err := initLogger(*flagLogLevel, *flagLogFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize logger: %v\n", err)
+		os.Exit(1)
 	}
-	if err := prometheus.Register(electricityCharge0Gauge); err != nil {
-		log.Fatalf("Failed to register electricity_charge_0_gauge gauge: %v", err)
+	config, err := LoadConfig(*flagConfigFile)
+	if err != nil {
+		logger.WithError(err).Fatalf("Failed to load configuration file '%s'", *flagConfigFile)
 	}
-	if err := prometheus.Register(electricityCharge1Gauge); err != nil {
-		log.Fatalf("Failed to register electricity_charge_1_gauge gauge: %v", err)
+
+	discoverers, err := newDiscoverers(config)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to configure discovery")
 	}
-	if err := prometheus.Register(electricityCharge2Gauge); err != nil {
-		log.Fatalf("Failed to register electricity_charge_2_gauge gauge: %v", err)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	devices, err := discoverAll(ctx, discoverers)
+	if err != nil {
+		logger.WithError(err).Fatal("Discovery failed")
 	}
-	if err := prometheus.Register(currentPowerGauge); err != nil {
-		log.Fatalf("Failed to register current_power gauge: %v", err)
+	devices, err = validateDevices(devices)
+	if err != nil {
+		logger.WithError(err).Fatal("Device validation failed")
 	}
+	collector := newTapoCollector(nil, config.Username, config.Password, *flagRetryInterval, *flagParallelism, *flagScrapeTimeout)
+
+	logger.WithField("count", len(devices)).Info("Trying to log in to Tapo plugs")
+	plugs := loginPlugs(ctx, collector, devices)
+	collector.setPlugs(plugs)
+	logger.WithField("count", len(plugs)).Info("Monitoring Tapo plugs")
+
+	cache := newScrapeCache(ctx, collector, *flagMaxAge, *flagHardTTL)
 
+	go refreshDiscovery(ctx, discoverers, collector, *flagDiscoveryInterval)
+
+	mux := http.NewServeMux()
+	mux.Handle(*flagPath, cache.Handler())
+	server := &http.Server{Addr: *flagListen, Handler: mux}
+
+	serverErr := make(chan error, 1)
 	go func() {
-		for {
-			for _, plug := range plugs {
-				log.Printf("Fetching metrics for plug %s", plug.Addr)
-				plug = tapo.NewPlug(plug.Addr, nil)
-				if err := plugLogin(plug, config.Username, config.Password, *flagStopOnKlapError); err != nil {
-					deviceRequestFailedGauge.WithLabelValues(plug.Addr.String(), err.Error()).Inc()
-					log.Printf("Warning: failed to log in on plug '%s': %v", plug.Addr, err)
-					continue
-				}
-				// TODO parallelize
-				var i *tapo.DeviceInfo
-				const maxAttempts = 3
-				for attempt := 1; attempt <= maxAttempts; attempt++ {
-					i, err = plug.GetDeviceInfo()
-					if err != nil {
-						deviceRequestFailedGauge.WithLabelValues(plug.Addr.String(), err.Error()).Inc()
-						log.Printf("GetDeviceInfo for plug '%s' failed at attempt %d, trying again in %s: %v", plug.Addr, attempt, *flagRetryInterval, err)
-						if attempt < maxAttempts {
-							time.Sleep(*flagRetryInterval)
-						}
-					} else {
-						break
-					}
-				}
-				if err != nil {
-					log.Fatalf("GetDeviceInfo failed after 3 attempts. Last error: %v", err)
-				}
-				var u *tapo.DeviceUsage
-				for attempt := 1; attempt <= maxAttempts; attempt++ {
-					u, err = plug.GetDeviceUsage()
-					if err != nil {
-						deviceRequestFailedGauge.WithLabelValues(plug.Addr.String(), err.Error()).Inc()
-						log.Printf("GetDeviceUsage for plug '%s' failed at attempt %d, trying again in %s: %v", plug.Addr, attempt, *flagRetryInterval, err)
-						if attempt < maxAttempts {
-							time.Sleep(*flagRetryInterval)
-						}
-					} else {
-						break
-					}
-				}
-				if err != nil {
-					log.Fatalf("GetDeviceUsage failed after 3 attempts. Last error: %v", err)
-				}
-				var e *tapo.EnergyUsage
-				// TODO always try to get energy usage without relying on a
-				// hardcoded list
-				hasPowerInformation := false
-				for _, m := range modelsWithPowerInformation {
-					if strings.ToLower(i.Model) == strings.ToLower(m) {
-						hasPowerInformation = true
-					}
-				}
-				if hasPowerInformation {
-					for attempt := 1; attempt <= maxAttempts; attempt++ {
-						e, err = plug.GetEnergyUsage()
-						if err != nil {
-							deviceRequestFailedGauge.WithLabelValues(plug.Addr.String(), err.Error()).Inc()
-							log.Printf("GetEnergyUsage for plug '%s' failed at attempt %d, trying again in %s: %v", plug.Addr, attempt, *flagRetryInterval, err)
-							if attempt < maxAttempts {
-								time.Sleep(*flagRetryInterval)
-							}
-						} else {
-							break
-						}
-					}
-					if err != nil {
-						log.Fatalf("GetEnergyUsage failed after 3 attempts. Last error: %v", err)
-					}
-				} else {
-					log.Printf("Ignoring device without power information ip=%s, model=%s", i.IP, i.Model)
-				}
-				labels := []string{
-					i.DeviceID, i.DecodedNickname, i.Model, i.MAC, i.OEMID,
-				}
-				allLabels := append(
-					labels,
-					i.FWVersion,
-					i.HWVersion,
-					i.Type,
-					i.HWID,
-					i.FWID,
-					i.IP,
-					strconv.FormatInt(int64(i.TimeDiff), 10),
-					i.DecodedSSID,
-					strconv.FormatInt(int64(i.RSSI), 10),
-					strconv.FormatInt(int64(i.SignalLevel), 10),
-					strconv.FormatInt(int64(i.Latitude), 10),
-					strconv.FormatInt(int64(i.Longitude), 10),
-					i.Lang,
-					i.Avatar,
-					i.Region,
-					i.Specs,
-					strconv.FormatBool(i.HasSetLocationInfo),
-					strconv.FormatBool(i.DeviceON),
-					strconv.FormatInt(int64(i.OnTime), 10),
-					strconv.FormatBool(i.OverHeated),
-					i.PowerProtectionStatus,
-					i.Location,
-				)
-				deviceInfoGauge.WithLabelValues(allLabels...).Set(1)
-				if i.DeviceON {
-					deviceOnGauge.WithLabelValues(labels...).Set(1)
-				} else {
-					deviceOnGauge.WithLabelValues(labels...).Set(0)
-				}
-				if i.OverHeated {
-					deviceOverheatedGauge.WithLabelValues(labels...).Set(1)
-				} else {
-					deviceOverheatedGauge.WithLabelValues(labels...).Set(0)
-				}
-				timeUsageTodayGauge.WithLabelValues(labels...).Set(float64(u.TimeUsage.Today))
-				timeUsagePast7Gauge.WithLabelValues(labels...).Set(float64(u.TimeUsage.Past7))
-				timeUsagePast30Gauge.WithLabelValues(labels...).Set(float64(u.TimeUsage.Past30))
-				powerUsageTodayGauge.WithLabelValues(labels...).Set(float64(u.PowerUsage.Today))
-				powerUsagePast7Gauge.WithLabelValues(labels...).Set(float64(u.PowerUsage.Past7))
-				powerUsagePast30Gauge.WithLabelValues(labels...).Set(float64(u.PowerUsage.Past30))
-				savedPowerTodayGauge.WithLabelValues(labels...).Set(float64(u.SavedPower.Today))
-				savedPowerPast7Gauge.WithLabelValues(labels...).Set(float64(u.SavedPower.Past7))
-				savedPowerPast30Gauge.WithLabelValues(labels...).Set(float64(u.SavedPower.Past30))
-				if e != nil {
-					todayRuntimeGauge.WithLabelValues(labels...).Set(float64(e.TodayRuntime))
-					monthRuntimeGauge.WithLabelValues(labels...).Set(float64(e.MonthRuntime))
-					todayEnergyGauge.WithLabelValues(labels...).Set(float64(e.TodayEnergy))
-					monthEnergyGauge.WithLabelValues(labels...).Set(float64(e.MonthEnergy))
-					electricityCharge0Gauge.WithLabelValues(labels...).Set(float64(e.ElectricityCharge[0]))
-					electricityCharge1Gauge.WithLabelValues(labels...).Set(float64(e.ElectricityCharge[1]))
-					electricityCharge2Gauge.WithLabelValues(labels...).Set(float64(e.ElectricityCharge[2]))
-					currentPowerGauge.WithLabelValues(labels...).Set(float64(e.CurrentPower))
-				}
-			}
-			log.Printf("Sleeping %s...", *flagSleepInterval)
-			time.Sleep(*flagSleepInterval)
-		}
+		logger.WithField("address", *flagListen).Info("Starting server")
+		serverErr <- server.ListenAndServe()
 	}()
 
-	http.Handle(*flagPath, promhttp.Handler())
-	log.Printf("Starting server on %s", *flagListen)
-	log.Fatal(http.ListenAndServe(*flagListen, nil))
+	select {
+	case err := <-serverErr:
+		if err != nil && err != http.ErrServerClosed {
+			logger.WithError(err).Fatal("Server failed")
+		}
+		return
+	case <-ctx.Done():
+		logger.Info("Shutting down")
+	}
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), *flagShutdownTimeout)
+	defer shutdownCancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.WithError(err).Error("Graceful shutdown failed")
+	}
 }
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/insomniacslk/tapo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// transportLogin performs the handshake for a plug and reconciles the
+// result with klapUnsupportedGauge: a TapoError(1003) (the error code
+// returned by devices whose firmware requires a handshake protocol this
+// client couldn't negotiate) marks the device unhealthy instead of being
+// silently swallowed, while a successful handshake clears the marker.
+//
+// The underlying tapo client (github.com/insomniacslk/tapo) always tries
+// KLAP first and falls back to passthrough on its own, and keeps no public
+// hook to observe or restrict which protocol was used, so per-device
+// protocol overrides cannot be implemented against it; none are exposed
+// here.
+func transportLogin(plug *tapo.Plug, username, password string, klapUnsupportedGauge *prometheus.GaugeVec) error {
+	device := plug.Addr.String()
+	err := plug.Handshake(username, password)
+	if err == nil {
+		klapUnsupportedGauge.WithLabelValues(device).Set(0)
+		return nil
+	}
+
+	var te tapo.TapoError
+	if errors.As(err, &te) && te == 1003 {
+		klapUnsupportedGauge.WithLabelValues(device).Set(1)
+		logger.WithFields(plugFields(plug)).WithError(err).Warn("Login failed: device did not accept any handshake protocol known to this client")
+		return err
+	}
+	klapUnsupportedGauge.WithLabelValues(device).Set(0)
+	logger.WithFields(plugFields(plug)).WithError(err).Error("Login failed")
+	return err
+}